@@ -15,8 +15,6 @@
 package swift
 
 import (
-	"encoding/json"
-
 	"github.com/coreos/quartermaster/pkg/operator"
 	"github.com/coreos/quartermaster/pkg/spec"
 	qmstorage "github.com/coreos/quartermaster/pkg/storage"
@@ -98,31 +96,66 @@ func New(client kubernetes.Interface, qm restclient.Interface) (qmstorage.Storag
 type SwiftStorage struct {
 	client kubernetes.Interface
 	qm     restclient.Interface
+	stopCh chan struct{}
 }
 
 func (st *SwiftStorage) Init() error {
 	logger.Debug("called")
+
+	// Drift on the Deployments/Services/ConfigMaps this driver owns (e.g.
+	// someone runs kubectl delete on swift-proxy-deploy) isn't otherwise
+	// noticed until the next AddCluster/AddNode callback, which may never
+	// come; the controller watches for it and re-applies syncSwift.
+	st.stopCh = make(chan struct{})
+	if err := st.startController(st.stopCh); err != nil {
+		return logger.Err(err)
+	}
+
 	return nil
 }
 
 func (st *SwiftStorage) AddCluster(c *spec.StorageCluster) (*spec.StorageCluster, error) {
 	logger.Info("Add cluster %v", c.GetName())
 
-	// Create rings
-	err := st.createRings(c)
-	if err != nil {
-		return nil, err
-	}
-
-	// Deploy swift proxies
-	err = st.deployProxy(c.Namespace)
-	if err != nil {
-		return nil, err
+	// Install Swift's components in the order a real cluster needs them:
+	// rings must exist before the proxy or storage nodes can start, and
+	// the proxy must be reachable before storage nodes are expected to
+	// serve traffic. Each phase is gated on the previous one actually
+	// being ready rather than just on its Deployment's replica count, and
+	// a failed phase rolls back everything AddCluster has created so far.
+	phases := []installPhase{
+		{
+			name:   "ring-master",
+			phase:  ClusterPhaseRingMaster,
+			create: func() error { return st.createRings(c) },
+			gate:   st.ringMasterReadyGate(c.Namespace),
+			rollback: func() error {
+				return st.deleteRingMaster(c.Namespace)
+			},
+		},
+		{
+			name:  "proxy",
+			phase: ClusterPhaseProxy,
+			create: func() error {
+				if err := st.deployProxy(c); err != nil {
+					return err
+				}
+				return st.deploySwiftProxyService(c.Namespace)
+			},
+			gate: st.proxyHealthcheckGate(c),
+			rollback: func() error {
+				return st.deleteProxy(c.Namespace)
+			},
+		},
+		{
+			name:   "storage-nodes",
+			phase:  ClusterPhaseStorageNodes,
+			create: func() error { return nil }, // QM creates StorageNodes, not the driver
+			gate:   st.storageNodesReadyGate(c.Namespace),
+		},
 	}
 
-	// Create service to access Swift Proxy API
-	err = st.deploySwiftProxyService(c.Namespace)
-	if err != nil {
+	if err := st.runInstallPhases(c, phases); err != nil {
 		return nil, err
 	}
 
@@ -132,41 +165,76 @@ func (st *SwiftStorage) AddCluster(c *spec.StorageCluster) (*spec.StorageCluster
 func (st *SwiftStorage) UpdateCluster(old *spec.StorageCluster,
 	new *spec.StorageCluster) error {
 	logger.Info("Updating cluster %v", old.GetName())
+
+	// The cluster's StorageNodes may have changed weight, zone, or device
+	// layout; rebalance is a no-op if the topology didn't actually change.
+	if err := st.rebalanceRings(new.Namespace); err != nil {
+		return err
+	}
+
+	// The AuthSpec or the Secret it references may have changed; this is
+	// a no-op unless the rendered proxy-server.conf actually differs.
+	if err := st.reconcileProxyAuth(new); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (st *SwiftStorage) DeleteCluster(c *spec.StorageCluster) error {
 	logger.Info("Deleting cluster %v", c.GetName())
 
-	services := st.client.Core().Services(c.Namespace)
-	err := services.Delete("swiftservice", nil)
-	if err != nil {
+	if err := st.deleteProxy(c.Namespace); err != nil {
 		return err
 	}
 
-	err = services.Delete("swift-ring-master-svc", nil)
-	if err != nil {
+	if err := st.deleteRingMaster(c.Namespace); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteProxy removes the swift-proxy Deployment and its Service. It is
+// used both by DeleteCluster and by the proxy install phase's rollback.
+func (st *SwiftStorage) deleteProxy(namespace string) error {
+	services := st.client.Core().Services(namespace)
+	if err := services.Delete("swiftservice", nil); err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
 	// TODO: deployment and replica set are being deleted, but the pod is not.
-	deployments := st.client.Extensions().Deployments(c.Namespace)
+	deployments := st.client.Extensions().Deployments(namespace)
 	orphanDependents := false
-	err = deployments.Delete("swift-proxy-deploy",
+	err := deployments.Delete("swift-proxy-deploy",
 		&meta.DeleteOptions{OrphanDependents: &orphanDependents})
-	if err != nil {
+	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
-	err = deployments.Delete("swift-ring-master-deploy",
+	return nil
+}
+
+// deleteRingMaster removes swift-ring-master's Deployment, Service and the
+// topology ConfigMap. It is used both by DeleteCluster and by the
+// ring-master install phase's rollback. Objects that are already gone are
+// not an error: DeleteCluster may be retried.
+func (st *SwiftStorage) deleteRingMaster(namespace string) error {
+	services := st.client.Core().Services(namespace)
+	if err := services.Delete("swift-ring-master-svc", nil); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	deployments := st.client.Extensions().Deployments(namespace)
+	orphanDependents := false
+	err := deployments.Delete("swift-ring-master-deploy",
 		&meta.DeleteOptions{OrphanDependents: &orphanDependents})
-	if err != nil {
+	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
-	configMaps := st.client.Core().ConfigMaps(c.Namespace)
-	err = configMaps.Delete("swift-cluster-configmap", nil)
-	if err != nil {
+	configMaps := st.client.Core().ConfigMaps(namespace)
+	if err := configMaps.Delete("swift-cluster-configmap", nil); err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
@@ -180,23 +248,70 @@ func (st *SwiftStorage) MakeDeployment(s *spec.StorageNode,
 	if s.Spec.Image == "" {
 		s.Spec.Image = "thiagodasilva/swift-storage:dev-v1"
 	}
-	spec, err := st.makeDeploymentSpec(s)
-	if err != nil {
-		return nil, err
-	}
+
 	lmap := make(map[string]string)
 	for k, v := range s.Labels {
 		lmap[k] = v
 	}
 	lmap["quartermaster"] = s.Name
+
+	cluster, err := st.getClusterForNamespace(s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if useHostPath(cluster) {
+		// Legacy mode: a single-replica, HostPath-backed Deployment.
+		spec, err := st.makeDeploymentSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		deployment := &v1beta1.Deployment{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        s.Name,
+				Namespace:   s.Namespace,
+				Annotations: s.Annotations,
+				Labels:      lmap,
+			},
+			Spec: *spec,
+		}
+		if old != nil {
+			deployment.Annotations = old.Annotations
+		}
+		return deployment, nil
+	}
+
+	// The real, PVC-backed workload for this node is the StatefulSet
+	// AddNode manages once QM reports this placeholder Deployment ready.
+	// It's kept at zero replicas so the QM StorageHandler contract (which
+	// still expects a Deployment back from this hook) is satisfied
+	// without QM ever actually scheduling a pod from it.
+	zero := int32(0)
 	deployment := &v1beta1.Deployment{
 		ObjectMeta: meta.ObjectMeta{
-			Name:        s.Name,
-			Namespace:   s.Namespace,
-			Annotations: s.Annotations,
-			Labels:      lmap,
+			Name:      s.Name,
+			Namespace: s.Namespace,
+			Annotations: map[string]string{
+				"description": "Placeholder for " + s.Name + "; real workload is a StatefulSet",
+			},
+			Labels: lmap,
+		},
+		Spec: v1beta1.DeploymentSpec{
+			Replicas: &zero,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: meta.ObjectMeta{
+					Labels: lmap,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Name:            s.Name,
+							Image:           s.Spec.Image,
+							ImagePullPolicy: v1.PullIfNotPresent,
+						},
+					},
+				},
+			},
 		},
-		Spec: *spec,
 	}
 	if old != nil {
 		deployment.Annotations = old.Annotations
@@ -254,7 +369,7 @@ func (st *SwiftStorage) makeDeploymentSpec(s *spec.StorageNode) (*v1beta1.Deploy
 							},
 							v1.ContainerPort{
 								// account server
-								ContainerPort: 6200,
+								ContainerPort: 6202,
 							},
 						},
 					},
@@ -274,12 +389,32 @@ func (st *SwiftStorage) makeDeploymentSpec(s *spec.StorageNode) (*v1beta1.Deploy
 
 func (st *SwiftStorage) AddNode(s *spec.StorageNode) (*spec.StorageNode, error) {
 	logger.Info("Adding node %v", s.GetName())
+
+	cluster, err := st.getClusterForNamespace(s.Namespace)
+	if err != nil {
+		return nil, logger.Err(err)
+	}
+	if !useHostPath(cluster) {
+		if err := st.ensureHeadlessService(s); err != nil {
+			return nil, logger.Err(err)
+		}
+		if err := st.ensureStorageStatefulSet(cluster, s); err != nil {
+			return nil, logger.Err(err)
+		}
+		if err := st.rebalanceRings(s.Namespace); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
 	svc := &v1.Service{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      s.GetName() + "-svc",
+			Name:            s.GetName() + "-svc",
+			OwnerReferences: []meta.OwnerReference{ownerReferenceForNode(s)},
 			Namespace: s.Namespace,
 			Labels: map[string]string{
-				"swift": "swift-storage",
+				"swift":         "swift-storage",
+				"quartermaster": "swift",
 			},
 			Annotations: map[string]string{
 				"description": "Exposes Swift Storage Service",
@@ -319,11 +454,20 @@ func (st *SwiftStorage) AddNode(s *spec.StorageNode) (*spec.StorageNode, error)
 
 	// Submit the service
 	services := st.client.Core().Services(s.Namespace)
-	_, err := services.Create(svc)
-	if apierrors.IsAlreadyExists(err) {
-		return nil, nil
-	} else if err != nil {
-		logger.Err(err)
+	_, err = services.Create(svc)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, logger.Err(err)
+	}
+
+	// Fall through to rebalanceRings even on AlreadyExists, the same way
+	// the StatefulSet branch above does: a retried AddNode for a node that
+	// already has its Service must still be a cheap, retry-safe reconcile
+	// rather than a silently dropped rebalance.
+	if err := st.rebalanceRings(s.Namespace); err != nil {
+		return nil, err
+	}
+	if err := st.rebalanceRings(s.Namespace); err != nil {
+		return nil, err
 	}
 
 	return nil, nil
@@ -331,16 +475,38 @@ func (st *SwiftStorage) AddNode(s *spec.StorageNode) (*spec.StorageNode, error)
 
 func (st *SwiftStorage) UpdateNode(s *spec.StorageNode) (*spec.StorageNode, error) {
 	logger.Info("Updating storage node %v", s.GetName())
+
+	// Weight and zone changes affect device placement; rebalanceRings
+	// compares the new topology hash against what's already deployed and
+	// only rebuilds the rings when something actually changed.
+	if err := st.rebalanceRings(s.Namespace); err != nil {
+		return nil, err
+	}
+
 	return nil, nil
 }
 
 func (st *SwiftStorage) DeleteNode(s *spec.StorageNode) error {
 	logger.Info("Deleting storage node %v", s.GetName())
+
+	if err := st.deleteStorageStatefulSet(s); err != nil {
+		return err
+	}
+
 	services := st.client.Core().Services(s.Namespace)
 	err := services.Delete(s.GetName()+"-svc", nil)
 	if err != nil {
 		return err
 	}
+
+	// Exclude s explicitly rather than assuming QM has already removed its
+	// StorageNode object by this point: listStorageNodes could still
+	// return it depending on exactly when QM's store catches up, and a
+	// stale entry here would leave a deleted node's devices in the ring.
+	if err := st.rebalanceRingsExcluding(s.Namespace, s.GetName()); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -350,7 +516,22 @@ func (st *SwiftStorage) Type() spec.StorageTypeIdentifier {
 	return spec.StorageTypeIdentifierSwift
 }
 
-func (st *SwiftStorage) deployProxy(namespace string) error {
+func (st *SwiftStorage) deployProxy(c *spec.StorageCluster) error {
+	namespace := c.Namespace
+
+	// Render proxy-server.conf for the cluster's AuthSpec before the
+	// Deployment is created, so the first pod to start already has a
+	// working auth pipeline to mount.
+	if _, err := st.deployProxyAuthConfig(c); err != nil {
+		return logger.Err(err)
+	}
+
+	auth, err := st.resolveAuth(c)
+	if err != nil {
+		return logger.Err(err)
+	}
+	probeEnv, readinessProbe := authProbe(auth)
+
 	volumes := []v1.Volume{
 		v1.Volume{
 			Name: "swift-proxy-etc",
@@ -360,6 +541,16 @@ func (st *SwiftStorage) deployProxy(namespace string) error {
 				},
 			},
 		},
+		v1.Volume{
+			Name: "swift-proxy-server-conf",
+			VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: "swift-proxy-server-conf",
+					},
+				},
+			},
+		},
 	}
 
 	mounts := []v1.VolumeMount{
@@ -369,11 +560,18 @@ func (st *SwiftStorage) deployProxy(namespace string) error {
 		},
 	}
 
+	proxyMounts := append(mounts, v1.VolumeMount{
+		Name:      "swift-proxy-server-conf",
+		MountPath: "/etc/swift/proxy-server.conf",
+		SubPath:   "proxy-server.conf",
+	})
+
 	replicas := int32(1)
 	proxyDeploy := &v1beta1.Deployment{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      "swift-proxy-deploy",
-			Namespace: namespace,
+			Name:            "swift-proxy-deploy",
+			Namespace:       namespace,
+			OwnerReferences: []meta.OwnerReference{ownerReference(c)},
 			Annotations: map[string]string{
 				"description": "Deployment spec for Swift proxy",
 			},
@@ -398,12 +596,14 @@ func (st *SwiftStorage) deployProxy(namespace string) error {
 							Name:            "swift-proxy",
 							Image:           "thiagodasilva/swift-proxy:dev-v1",
 							ImagePullPolicy: v1.PullIfNotPresent,
-							VolumeMounts:    mounts,
+							VolumeMounts:    proxyMounts,
+							Env:             probeEnv,
 							Ports: []v1.ContainerPort{
 								v1.ContainerPort{
 									ContainerPort: 8080,
 								},
 							},
+							ReadinessProbe: readinessProbe,
 						},
 						v1.Container{
 							Name:            "swift-ring-minion",
@@ -419,7 +619,7 @@ func (st *SwiftStorage) deployProxy(namespace string) error {
 	}
 
 	deployments := st.client.Extensions().Deployments(namespace)
-	_, err := deployments.Create(proxyDeploy)
+	_, err = deployments.Create(proxyDeploy)
 	if apierrors.IsAlreadyExists(err) {
 		return nil
 	} else if err != nil {
@@ -440,10 +640,12 @@ func (st *SwiftStorage) deployProxy(namespace string) error {
 func (st *SwiftStorage) deploySwiftProxyService(namespace string) error {
 	s := &v1.Service{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      "swiftservice",
-			Namespace: namespace,
+			Name:            "swiftservice",
+			Namespace:       namespace,
+			OwnerReferences: st.ownerReferencesForNamespace(namespace),
 			Labels: map[string]string{
-				"swift": "swift-service",
+				"swift":         "swift-service",
+				"quartermaster": "swift",
 			},
 			Annotations: map[string]string{
 				"description": "Exposes Swift Proxy Service",
@@ -480,8 +682,9 @@ func (st *SwiftStorage) deploySwiftProxyService(namespace string) error {
 }
 
 func (st *SwiftStorage) createRings(c *spec.StorageCluster) error {
-	// Create configMap with cluster topology
-	err := st.createConfigMap(c)
+	// Create configMap with the current cluster topology. There may be no
+	// StorageNodes yet; AddNode will rebalance again once they show up.
+	err := st.rebalanceRings(c.Namespace)
 	if err != nil {
 		return err
 	}
@@ -512,8 +715,9 @@ func (st *SwiftStorage) createRings(c *spec.StorageCluster) error {
 	replicas := int32(1)
 	ringMasterDeploy := &v1beta1.Deployment{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      "swift-ring-master-deploy",
-			Namespace: c.Namespace,
+			Name:            "swift-ring-master-deploy",
+			Namespace:       c.Namespace,
+			OwnerReferences: []meta.OwnerReference{ownerReference(c)},
 			Annotations: map[string]string{
 				"description": "Deployment spec for Swift Ring Master",
 			},
@@ -554,21 +758,24 @@ func (st *SwiftStorage) createRings(c *spec.StorageCluster) error {
 
 	deployments := st.client.Extensions().Deployments(c.Namespace)
 	_, err = deployments.Create(ringMasterDeploy)
-	if apierrors.IsAlreadyExists(err) {
-		return nil
-	} else if err != nil {
-		logger.Err(err)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return logger.Err(err)
 	}
 
-	// Wait until deployment ready
-	err = waitForDeploymentFn(st.client, c.Namespace,
-		ringMasterDeploy.GetName(), *ringMasterDeploy.Spec.Replicas)
-	if err != nil {
-		return logger.Err(err)
+	if err == nil {
+		// Only wait on a freshly-created Deployment; one that already
+		// existed is either already ready or being handled by its own
+		// earlier createRings call.
+		if err := waitForDeploymentFn(st.client, c.Namespace,
+			ringMasterDeploy.GetName(), *ringMasterDeploy.Spec.Replicas); err != nil {
+			return logger.Err(err)
+		}
 	}
 
-	err = st.deploySwiftRingMasterService(c.Namespace)
-	if err != nil {
+	// Run unconditionally, even when the Deployment already existed: this
+	// is what lets syncSwift's drift resync recreate swift-ring-master-svc
+	// if it's ever deleted out from under QM while the Deployment survives.
+	if err := st.deploySwiftRingMasterService(c.Namespace); err != nil {
 		return logger.Err(err)
 	}
 
@@ -580,10 +787,12 @@ func (st *SwiftStorage) createRings(c *spec.StorageCluster) error {
 func (st *SwiftStorage) deploySwiftRingMasterService(namespace string) error {
 	s := &v1.Service{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      "swift-ring-master-svc",
-			Namespace: namespace,
+			Name:            "swift-ring-master-svc",
+			Namespace:       namespace,
+			OwnerReferences: st.ownerReferencesForNamespace(namespace),
 			Labels: map[string]string{
-				"swift": "swift-ring-master-svc",
+				"swift":         "swift-ring-master-svc",
+				"quartermaster": "swift",
 			},
 			Annotations: map[string]string{
 				"description": "Exposes Swift Ring Master Service",
@@ -619,25 +828,3 @@ func (st *SwiftStorage) deploySwiftRingMasterService(namespace string) error {
 	logger.Debug("swift ring master service created")
 	return nil
 }
-
-func (st *SwiftStorage) createConfigMap(c *spec.StorageCluster) error {
-	cluster, _ := json.Marshal(c)
-	clusterConfMap := &v1.ConfigMap{
-		ObjectMeta: meta.ObjectMeta{
-			Name: "swift-cluster-configmap",
-		},
-		Data: map[string]string{
-			"cluster.json": string(cluster),
-		},
-	}
-	configMaps := st.client.Core().ConfigMaps(c.Namespace)
-	_, err := configMaps.Create(clusterConfMap)
-	if apierrors.IsAlreadyExists(err) {
-		return nil
-	} else if err != nil {
-		logger.Err(err)
-		return err
-	}
-	logger.Debug("created config map")
-	return nil
-}
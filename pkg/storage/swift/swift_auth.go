@@ -0,0 +1,309 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// authConfigVersionAnnotation records the hash of the rendered
+// proxy-server.conf, so UpdateCluster only rolls the proxy when the
+// rendered auth pipeline actually changed.
+const authConfigVersionAnnotation = "swift.quartermaster.coreos.com/auth-config-version"
+
+const proxyServerConfTemplate = `[DEFAULT]
+bind_port = 8080
+workers = 2
+
+[pipeline:main]
+pipeline = catch_errors gatekeeper healthcheck proxy-logging cache {{.AuthMiddleware}} proxy-logging proxy-server
+
+[app:proxy-server]
+use = egg:swift#proxy
+account_autocreate = true
+
+[filter:cache]
+use = egg:swift#memcache
+
+[filter:catch_errors]
+use = egg:swift#catch_errors
+
+[filter:gatekeeper]
+use = egg:swift#gatekeeper
+
+[filter:healthcheck]
+use = egg:swift#healthcheck
+
+[filter:proxy-logging]
+use = egg:swift#proxy_logging
+{{if .TempAuthUsers}}
+[filter:tempauth]
+use = egg:swift#tempauth
+{{range .TempAuthUsers}}user_{{.Name}} = {{.Key}}
+{{end}}{{end}}{{if .Keystone}}
+[filter:authtoken]
+use = egg:swift#keystoneauth
+auth_url = {{.Keystone.AuthURL}}
+admin_user = {{.Keystone.AdminUser}}
+admin_tenant_name = {{.Keystone.AdminTenant}}
+admin_password = {{.Keystone.AdminPassword}}
+
+[filter:keystoneauth]
+use = egg:swift#keystoneauth
+operator_roles = admin, swiftoperator
+{{end}}`
+
+// renderedAuth is the data passed to proxyServerConfTemplate; it flattens
+// spec.AuthSpec plus the admin_password pulled out of the referenced
+// Secret, so the template itself never has to reach into the client-go API.
+type renderedAuth struct {
+	AuthMiddleware string
+	TempAuthUsers  []renderedTempAuthUser
+	Keystone       *renderedKeystoneAuth
+}
+
+// renderedTempAuthUser is one user_<name> = <key> line. TempAuthUsers is
+// built as a slice sorted by Name, rather than ranging spec.SwiftTempAuthSpec's
+// Users map directly in the template, so renderProxyServerConf's hash stays
+// stable across repeated renders of the same user set instead of tracking
+// the template engine's map-iteration order.
+type renderedTempAuthUser struct {
+	Name string
+	Key  string
+}
+
+type renderedKeystoneAuth struct {
+	AuthURL       string
+	AdminUser     string
+	AdminTenant   string
+	AdminPassword string
+}
+
+// resolveAuth turns spec.AuthSpec into renderedAuth, fetching the admin
+// password from the Secret it references when Keystone auth is configured.
+func (st *SwiftStorage) resolveAuth(c *spec.StorageCluster) (*renderedAuth, error) {
+	auth := c.Spec.Swift.Auth
+
+	switch {
+	case auth.TempAuth != nil:
+		users := make([]renderedTempAuthUser, 0, len(auth.TempAuth.Users))
+		for name, key := range auth.TempAuth.Users {
+			users = append(users, renderedTempAuthUser{Name: name, Key: key})
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+		return &renderedAuth{
+			AuthMiddleware: "tempauth",
+			TempAuthUsers:  users,
+		}, nil
+
+	case auth.Keystone != nil:
+		secrets := st.client.Core().Secrets(c.Namespace)
+		secret, err := secrets.Get(auth.Keystone.SecretName, meta.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &renderedAuth{
+			AuthMiddleware: "authtoken keystoneauth",
+			Keystone: &renderedKeystoneAuth{
+				AuthURL:       auth.Keystone.AuthURL,
+				AdminUser:     auth.Keystone.AdminUser,
+				AdminTenant:   auth.Keystone.AdminTenant,
+				AdminPassword: string(secret.Data["admin-password"]),
+			},
+		}, nil
+
+	default:
+		// A proxy with no auth filter in its pipeline accepts every request
+		// as anonymous; fail closed rather than deploy something that
+		// looks up but isn't actually usable by real clients.
+		return nil, fmt.Errorf("cluster %v: Spec.Swift.Auth must configure TempAuth or Keystone", c.GetName())
+	}
+}
+
+// renderProxyServerConf renders proxy-server.conf for c's configured auth
+// pipeline and returns its text and a stable hash of that text.
+func (st *SwiftStorage) renderProxyServerConf(c *spec.StorageCluster) (string, string, error) {
+	auth, err := st.resolveAuth(c)
+	if err != nil {
+		return "", "", err
+	}
+
+	tmpl, err := template.New("proxy-server.conf").Parse(proxyServerConfTemplate)
+	if err != nil {
+		return "", "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, auth); err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.String(), hex.EncodeToString(sum[:]), nil
+}
+
+// tempAuthProbeScript and keystoneProbeScript are run by swift-proxy's
+// readiness probe. An unauthenticated GET /info would stay "ready" even if
+// the auth filter were completely broken, so the probe instead logs in the
+// same way a real client would and only reports ready once an authenticated
+// GET /info succeeds.
+const tempAuthProbeScript = `set -e
+TOKEN=$(curl -sf -D - -o /dev/null -H "X-Storage-User: $PROBE_USER" -H "X-Storage-Pass: $PROBE_KEY" http://localhost:8080/auth/v1.0 | tr -d '\r' | sed -n 's/^X-Auth-Token: //p')
+test -n "$TOKEN"
+curl -sf -H "X-Auth-Token: $TOKEN" http://localhost:8080/info >/dev/null
+`
+
+const keystoneProbeScript = `set -e
+TOKEN=$(curl -sf -X POST "$PROBE_KEYSTONE_AUTH_URL/tokens" -H "Content-Type: application/json" -d "{\"auth\":{\"tenantName\":\"$PROBE_TENANT\",\"passwordCredentials\":{\"username\":\"$PROBE_USER\",\"password\":\"$PROBE_KEY\"}}}" | sed -n 's/.*"id" *: *"\([^"]*\)".*/\1/p' | head -1)
+test -n "$TOKEN"
+curl -sf -H "X-Auth-Token: $TOKEN" http://localhost:8080/info >/dev/null
+`
+
+// authProbe builds the Env and Exec readiness probe swift-proxy's container
+// needs to log into auth before checking /info, instead of an
+// unauthenticated HTTPGet that would pass even with a broken auth filter.
+func authProbe(auth *renderedAuth) ([]v1.EnvVar, *v1.Probe) {
+	var env []v1.EnvVar
+	var script string
+
+	switch {
+	case len(auth.TempAuthUsers) > 0:
+		u := auth.TempAuthUsers[0]
+		env = []v1.EnvVar{
+			{Name: "PROBE_USER", Value: u.Name},
+			{Name: "PROBE_KEY", Value: u.Key},
+		}
+		script = tempAuthProbeScript
+
+	case auth.Keystone != nil:
+		env = []v1.EnvVar{
+			{Name: "PROBE_USER", Value: auth.Keystone.AdminUser},
+			{Name: "PROBE_KEY", Value: auth.Keystone.AdminPassword},
+			{Name: "PROBE_TENANT", Value: auth.Keystone.AdminTenant},
+			{Name: "PROBE_KEYSTONE_AUTH_URL", Value: auth.Keystone.AuthURL},
+		}
+		script = keystoneProbeScript
+	}
+
+	return env, &v1.Probe{
+		Handler: v1.Handler{
+			Exec: &v1.ExecAction{
+				Command: []string{"sh", "-c", script},
+			},
+		},
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+	}
+}
+
+// deployProxyAuthConfig creates or updates the swift-proxy-server-conf
+// ConfigMap from c's AuthSpec. It returns whether the rendered
+// configuration actually changed, so the caller knows whether the proxy
+// Deployment needs to roll.
+func (st *SwiftStorage) deployProxyAuthConfig(c *spec.StorageCluster) (bool, error) {
+	rendered, version, err := st.renderProxyServerConf(c)
+	if err != nil {
+		return false, err
+	}
+
+	configMaps := st.client.Core().ConfigMaps(c.Namespace)
+	existing, err := configMaps.Get("swift-proxy-server-conf", meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm := &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Name:            "swift-proxy-server-conf",
+				Namespace:       c.Namespace,
+				OwnerReferences: []meta.OwnerReference{ownerReference(c)},
+				Labels: map[string]string{
+					"quartermaster": "swift",
+				},
+				Annotations: map[string]string{
+					authConfigVersionAnnotation: version,
+				},
+			},
+			Data: map[string]string{
+				"proxy-server.conf": rendered,
+			},
+		}
+		_, err = configMaps.Create(cm)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return false, err
+		}
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if existing.Annotations[authConfigVersionAnnotation] == version {
+		return false, nil
+	}
+
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[authConfigVersionAnnotation] = version
+	existing.Data["proxy-server.conf"] = rendered
+	_, err = configMaps.Update(existing)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reconcileProxyAuth rolls out swift-proxy-server-conf for c's current
+// AuthSpec and Secret, and rolls the proxy Deployment when the rendered
+// config actually changed. Called from UpdateCluster whenever the
+// cluster's AuthSpec or backing Secret may have changed.
+func (st *SwiftStorage) reconcileProxyAuth(c *spec.StorageCluster) error {
+	changed, err := st.deployProxyAuthConfig(c)
+	if err != nil {
+		return logger.Err(err)
+	}
+	if !changed {
+		return nil
+	}
+
+	deployments := st.client.Extensions().Deployments(c.Namespace)
+	patch := []byte(fmt.Sprintf(
+		`{"spec":{"template":{"metadata":{"annotations":{"swift.quartermaster.coreos.com/restartedAt":%q}}}}}`,
+		time.Now().UTC().Format(time.RFC3339)))
+
+	_, err = deployments.Patch("swift-proxy-deploy", types.StrategicMergePatchType, patch)
+	if apierrors.IsNotFound(err) {
+		// Proxy isn't deployed yet; deployProxy will mount the configmap
+		// we just wrote when it creates the Deployment.
+		return nil
+	}
+	if err != nil {
+		return logger.Err(err)
+	}
+
+	logger.Info("rotated swift-proxy auth config for cluster %v", c.GetName())
+	return nil
+}
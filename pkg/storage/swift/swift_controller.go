@@ -0,0 +1,264 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// swiftLabelSelector matches every object this package labels
+// quartermaster=swift, so the controller's informers only ever see
+// resources it owns. Per-node StatefulSets carry quartermaster=<node name>
+// and are not matched.
+const swiftLabelSelector = "quartermaster=swift"
+
+// swiftController watches the Deployments, Services and ConfigMaps this
+// package creates and re-applies syncSwift whenever one is changed or
+// deleted out from under QM, following the informer + rate-limited
+// workqueue pattern most Kubernetes controllers use instead of relying
+// solely on QM's one-shot AddCluster/AddNode callbacks.
+type swiftController struct {
+	st     *SwiftStorage
+	queue  workqueue.RateLimitingInterface
+	synced []cache.InformerSynced
+}
+
+// startController builds and runs the drift-detection controller in the
+// background. It returns once the informers' caches have synced; close
+// stopCh to shut it down.
+func (st *SwiftStorage) startController(stopCh <-chan struct{}) error {
+	c := &swiftController{
+		st:    st,
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "swift"),
+	}
+
+	selector, err := labels.Parse(swiftLabelSelector)
+	if err != nil {
+		return err
+	}
+
+	deployments := st.client.Extensions().Deployments(api.NamespaceAll)
+	services := st.client.Core().Services(api.NamespaceAll)
+	configMaps := st.client.Core().ConfigMaps(api.NamespaceAll)
+
+	informers := []cache.SharedIndexInformer{
+		c.newInformer(&v1beta1.Deployment{}, selector,
+			func(o meta.ListOptions) (runtime.Object, error) { return deployments.List(o) },
+			func(o meta.ListOptions) (watch.Interface, error) { return deployments.Watch(o) }),
+		c.newInformer(&v1.Service{}, selector,
+			func(o meta.ListOptions) (runtime.Object, error) { return services.List(o) },
+			func(o meta.ListOptions) (watch.Interface, error) { return services.Watch(o) }),
+		c.newInformer(&v1.ConfigMap{}, selector,
+			func(o meta.ListOptions) (runtime.Object, error) { return configMaps.List(o) },
+			func(o meta.ListOptions) (watch.Interface, error) { return configMaps.Watch(o) }),
+	}
+
+	for _, informer := range informers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.enqueueOwner,
+			UpdateFunc: func(old, new interface{}) { c.enqueueOwner(new) },
+			DeleteFunc: c.enqueueOwner,
+		})
+		c.synced = append(c.synced, informer.HasSynced)
+		go informer.Run(stopCh)
+	}
+
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		return fmt.Errorf("swift controller: caches never synced")
+	}
+
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	logger.Info("swift controller started, watching %v", swiftLabelSelector)
+	return nil
+}
+
+// newInformer returns a SharedIndexInformer scoped to everything in all
+// namespaces labelled with selector, backed by listFunc/watchFunc against
+// st.client (not st.qm: Deployments/Services/ConfigMaps live on the real
+// Kubernetes API, not QM's custom-resource apiserver). expected is the
+// resource's own client-go type, e.g. &v1beta1.Deployment{}, so the
+// reflector's type check accepts the events it receives.
+func (c *swiftController) newInformer(expected runtime.Object, selector labels.Selector,
+	listFunc func(meta.ListOptions) (runtime.Object, error),
+	watchFunc func(meta.ListOptions) (watch.Interface, error)) cache.SharedIndexInformer {
+
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector.String()
+			return listFunc(options)
+		},
+		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector.String()
+			return watchFunc(options)
+		},
+	}
+	return cache.NewSharedIndexInformer(listWatch, expected, 30*time.Second, cache.Indexers{})
+}
+
+// enqueueOwner finds the StorageCluster that owns obj (via
+// OwnerReferences) and pushes its namespace/name key onto the workqueue.
+// Objects quartermaster didn't create (no matching owner reference) are
+// ignored.
+func (c *swiftController) enqueueOwner(obj interface{}) {
+	accessor, err := apimeta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	for _, ref := range accessor.GetOwnerReferences() {
+		if ref.Kind == "StorageCluster" {
+			c.queue.Add(accessor.GetNamespace() + "/" + ref.Name)
+			return
+		}
+	}
+}
+
+// runWorker pops keys off the queue until it's shut down, re-syncing the
+// owning StorageCluster for each one.
+func (c *swiftController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *swiftController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.syncKey(key.(string)); err != nil {
+		logger.Err(fmt.Errorf("swift controller: resync of %v failed, requeueing: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// syncKey re-applies syncSwift for the "namespace/name" key popped off the
+// workqueue.
+func (c *swiftController) syncKey(key string) error {
+	namespace, name, err := splitNamespaceName(key)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := c.st.getStorageCluster(namespace, name)
+	if err != nil {
+		// The StorageCluster itself is gone; nothing to reconcile.
+		return nil
+	}
+
+	return c.st.syncSwift(cluster)
+}
+
+func splitNamespaceName(key string) (string, string, error) {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' {
+			return key[:i], key[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid queue key %q", key)
+}
+
+// getStorageCluster fetches a single named StorageCluster.
+func (st *SwiftStorage) getStorageCluster(namespace, name string) (*spec.StorageCluster, error) {
+	c := &spec.StorageCluster{}
+	err := st.qm.Get().
+		Namespace(namespace).
+		Resource("storageclusters").
+		Name(name).
+		Do().
+		Into(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// syncSwift is the idempotent union of createRings, deployProxy and
+// deploySwiftProxyService: every create call underneath it already
+// tolerates AlreadyExists, so running it again after drift just recreates
+// whatever is missing and leaves the rest untouched.
+func (st *SwiftStorage) syncSwift(c *spec.StorageCluster) error {
+	logger.Debug("resyncing swift cluster %v", c.GetName())
+
+	if err := st.createRings(c); err != nil {
+		return err
+	}
+	if err := st.deployProxy(c); err != nil {
+		return err
+	}
+	if err := st.deploySwiftProxyService(c.Namespace); err != nil {
+		return err
+	}
+	return st.rebalanceRings(c.Namespace)
+}
+
+// ownerReference builds the OwnerReference every child object of c should
+// carry, so garbage collection removes them automatically when c is
+// deleted.
+func ownerReference(c *spec.StorageCluster) meta.OwnerReference {
+	controller := true
+	return meta.OwnerReference{
+		APIVersion: c.APIVersion,
+		Kind:       c.Kind,
+		Name:       c.GetName(),
+		UID:        c.GetUID(),
+		Controller: &controller,
+	}
+}
+
+// ownerReferenceForNode builds the OwnerReference a StorageNode's own
+// child objects (its Service, StatefulSet) should carry.
+func ownerReferenceForNode(s *spec.StorageNode) meta.OwnerReference {
+	controller := true
+	return meta.OwnerReference{
+		APIVersion: s.APIVersion,
+		Kind:       s.Kind,
+		Name:       s.GetName(),
+		UID:        s.GetUID(),
+		Controller: &controller,
+	}
+}
+
+// ownerReferencesForNamespace is a best-effort OwnerReference list for
+// objects (like swift-cluster-configmap) that are only ever namespace-
+// scoped rather than tied to a specific StorageNode. It's empty, rather
+// than an error, when no StorageCluster can be found yet.
+func (st *SwiftStorage) ownerReferencesForNamespace(namespace string) []meta.OwnerReference {
+	cluster, err := st.getClusterForNamespace(namespace)
+	if err != nil {
+		return nil
+	}
+	return []meta.OwnerReference{ownerReference(cluster)}
+}
@@ -0,0 +1,354 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+)
+
+// Cluster phases reported on StorageCluster.Status.Phase while AddCluster
+// works its way through installPhases. "Ready" is set once every phase's
+// gate has passed.
+const (
+	ClusterPhaseRingMaster   = "RingMasterPending"
+	ClusterPhaseProxy        = "ProxyPending"
+	ClusterPhaseStorageNodes = "StorageNodesPending"
+	ClusterPhaseReady        = "Ready"
+	ClusterPhaseRollingBack  = "RollingBack"
+
+	defaultPhaseGateTimeout = 2 * time.Minute
+	defaultPhaseGateBackoff = 500 * time.Millisecond
+	defaultPhaseGateMaxWait = 10 * time.Second
+)
+
+// installPhase is one step of the ordered install pipeline. create runs the
+// phase's API calls; gate is polled with exponential backoff until it
+// returns nil or timeout elapses; rollback undoes create if a later phase's
+// gate never passes, so AddCluster as a whole stays atomic.
+type installPhase struct {
+	name     string
+	phase    string
+	create   func() error
+	gate     func() error
+	rollback func() error
+	timeout  time.Duration
+}
+
+// runInstallPhases runs phases in order, gating each one before starting
+// the next. If any phase's create or gate fails, every phase that already
+// completed is rolled back in reverse order and the first error is
+// returned, so a partially-applied AddCluster never lingers.
+func (st *SwiftStorage) runInstallPhases(c *spec.StorageCluster, phases []installPhase) error {
+	completed := make([]installPhase, 0, len(phases))
+
+	for _, p := range phases {
+		logger.Info("cluster %v: entering phase %v", c.GetName(), p.name)
+		if err := st.setClusterPhase(c, p.phase); err != nil {
+			logger.Debug("cluster %v: failed to record phase %v: %v", c.GetName(), p.name, err)
+		}
+
+		if err := p.create(); err != nil {
+			// create() may have partially succeeded (e.g. it created a
+			// Deployment but failed on the Service after it); roll this
+			// phase back too, not just the ones that fully completed
+			// before it, so AddCluster never leaves orphaned resources
+			// behind from the phase that actually failed.
+			st.rollbackPhases(c, append(completed, p))
+			return logger.Err(fmt.Errorf("phase %v failed to create resources: %v", p.name, err))
+		}
+
+		timeout := p.timeout
+		if timeout == 0 {
+			timeout = defaultPhaseGateTimeout
+		}
+		if err := waitForGateFn(p.gate, timeout); err != nil {
+			completed = append(completed, p)
+			st.rollbackPhases(c, completed)
+			return logger.Err(fmt.Errorf("phase %v never became ready: %v", p.name, err))
+		}
+
+		completed = append(completed, p)
+		logger.Info("cluster %v: phase %v ready", c.GetName(), p.name)
+	}
+
+	if err := st.setClusterPhase(c, ClusterPhaseReady); err != nil {
+		logger.Debug("cluster %v: failed to record ready phase: %v", c.GetName(), err)
+	}
+	return nil
+}
+
+// rollbackPhases undoes every completed phase in reverse order so that a
+// failed AddCluster doesn't leave half-created resources behind.
+func (st *SwiftStorage) rollbackPhases(c *spec.StorageCluster, completed []installPhase) {
+	if len(completed) == 0 {
+		return
+	}
+	st.setClusterPhase(c, ClusterPhaseRollingBack)
+	for i := len(completed) - 1; i >= 0; i-- {
+		p := completed[i]
+		if p.rollback == nil {
+			continue
+		}
+		if err := p.rollback(); err != nil {
+			logger.Err(fmt.Errorf("cluster %v: rollback of phase %v failed: %v", c.GetName(), p.name, err))
+		}
+	}
+}
+
+// waitForGateFn polls a phase's gate until it's ready. It's a package
+// variable, like waitForDeploymentFn, so tests can stub it out instead of
+// waiting on real HTTP/TCP gates that only exist against a live cluster.
+var waitForGateFn = waitForGate
+
+// waitForGate polls gate with exponential backoff (capped at
+// defaultPhaseGateMaxWait) until it returns nil or timeout elapses.
+func waitForGate(gate func() error, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := defaultPhaseGateBackoff
+	var lastErr error
+
+	for {
+		if err := gate(); err == nil {
+			return nil
+		} else {
+			lastErr = err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gate not ready after %v: %v", timeout, lastErr)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > defaultPhaseGateMaxWait {
+			backoff = defaultPhaseGateMaxWait
+		}
+	}
+}
+
+// ringMasterReadyGate is Phase 1's gate: the ring-master service must
+// answer :8090/ready with 200. The response body is not inspected, so no
+// rings checksum is checked.
+func (st *SwiftStorage) ringMasterReadyGate(namespace string) func() error {
+	return func() error {
+		url := fmt.Sprintf("http://swift-ring-master-svc.%v.svc:8090/ready", namespace)
+		return httpGetOK(url)
+	}
+}
+
+// proxyHealthcheckGate is Phase 2's gate: the swift proxy must answer
+// /healthcheck with status 200 (the body is not checked), and an actual
+// login against c's configured auth pipeline must be able to fetch /info.
+// The login is what catches a proxy whose tempauth/keystone filter is
+// misconfigured; an unauthenticated /info would otherwise look fine.
+func (st *SwiftStorage) proxyHealthcheckGate(c *spec.StorageCluster) func() error {
+	return func() error {
+		base := fmt.Sprintf("http://swiftservice.%v.svc:8080", c.Namespace)
+		if err := httpGetOK(base + "/healthcheck"); err != nil {
+			return err
+		}
+
+		auth, err := st.resolveAuth(c)
+		if err != nil {
+			return err
+		}
+
+		var token string
+		switch {
+		case len(auth.TempAuthUsers) > 0:
+			u := auth.TempAuthUsers[0]
+			token, err = tempAuthToken(base, u.Name, u.Key)
+		case auth.Keystone != nil:
+			token, err = keystoneToken(auth.Keystone.AuthURL, auth.Keystone.AdminTenant,
+				auth.Keystone.AdminUser, auth.Keystone.AdminPassword)
+		default:
+			return fmt.Errorf("no auth configured for cluster %v", c.GetName())
+		}
+		if err != nil {
+			return err
+		}
+
+		return httpGetOKWithToken(base+"/info", token)
+	}
+}
+
+// storageNodesReadyGate is Phase 3's gate: every StorageNode already known
+// to QM must be answering on its object/container/account ports. A cluster
+// with no nodes yet passes vacuously; QM will add nodes afterwards and
+// AddNode drives its own readiness via the normal Deployment wait. Address
+// resolution mirrors buildTopology: a StatefulSet-backed node (the default)
+// is dialed at its stable <node>-0.<svc> DNS name instead of a
+// StorageNetwork IP, since its headless Service has no ClusterIP of its own.
+func (st *SwiftStorage) storageNodesReadyGate(namespace string) func() error {
+	return func() error {
+		nodes, err := st.listStorageNodes(namespace)
+		if err != nil {
+			return err
+		}
+
+		cluster, err := st.getClusterForNamespace(namespace)
+		if err != nil {
+			logger.Debug("no cluster found for %v yet, falling back to node IPs: %v", namespace, err)
+		}
+
+		for _, n := range nodes {
+			host := ""
+			if cluster != nil && !useHostPath(cluster) {
+				host = storageNodeHostname(&n)
+			} else if len(n.Spec.StorageNetwork.IPs) > 0 {
+				host = n.Spec.StorageNetwork.IPs[0]
+			} else {
+				return fmt.Errorf("node %v has no storage network IP yet", n.GetName())
+			}
+
+			for _, port := range []int{6200, 6201, 6202} {
+				if err := tcpDial(host, port); err != nil {
+					return fmt.Errorf("node %v port %v not reachable: %v", n.GetName(), port, err)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// setClusterPhase stamps the phase currently in progress onto the
+// StorageCluster's status so operators can see AddCluster's progress with
+// kubectl instead of only in the driver's logs. It's a thin wrapper around
+// the setClusterPhaseFn package variable so tests can stub it out the same
+// way they stub waitForDeploymentFn.
+func (st *SwiftStorage) setClusterPhase(c *spec.StorageCluster, phase string) error {
+	return setClusterPhaseFn(st, c, phase)
+}
+
+var setClusterPhaseFn = func(st *SwiftStorage, c *spec.StorageCluster, phase string) error {
+	c.Status.Phase = phase
+	return st.qm.Put().
+		Namespace(c.Namespace).
+		Resource("storageclusters").
+		Name(c.GetName()).
+		SubResource("status").
+		Body(c).
+		Do().
+		Error()
+}
+
+func tcpDial(ip string, port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", ip, port), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func httpGetOK(url string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// httpGetOKWithToken is httpGetOK with an X-Auth-Token header attached, so
+// the gate actually exercises the authenticated request path a real client
+// would make.
+func httpGetOKWithToken(url, token string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// tempAuthToken logs into base's tempauth pipeline the same way a real
+// client would and returns the X-Auth-Token it's issued.
+func tempAuthToken(base, user, key string) (string, error) {
+	req, err := http.NewRequest("GET", base+"/auth/v1.0", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Storage-User", user)
+	req.Header.Set("X-Storage-Pass", key)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tempauth login returned %v", resp.StatusCode)
+	}
+
+	token := resp.Header.Get("X-Auth-Token")
+	if token == "" {
+		return "", fmt.Errorf("tempauth login did not return an X-Auth-Token")
+	}
+	return token, nil
+}
+
+// keystoneToken requests a Keystone v2 token for the admin credentials
+// resolveAuth pulled out of the cluster's Keystone Secret.
+func keystoneToken(authURL, tenant, user, password string) (string, error) {
+	body := fmt.Sprintf(`{"auth":{"tenantName":%q,"passwordCredentials":{"username":%q,"password":%q}}}`,
+		tenant, user, password)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(authURL+"/tokens", "application/json", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("keystone token request returned %v", resp.StatusCode)
+	}
+
+	var parsed struct {
+		Access struct {
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+		} `json:"access"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", err
+	}
+	if parsed.Access.Token.ID == "" {
+		return "", fmt.Errorf("keystone token response missing token id")
+	}
+	return parsed.Access.Token.ID, nil
+}
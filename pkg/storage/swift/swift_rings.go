@@ -0,0 +1,255 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// topologyVersionAnnotation records the hash of the last topology pushed to
+// swift-ring-master, so rebalanceRings is a no-op when nothing moved.
+const topologyVersionAnnotation = "swift.quartermaster.coreos.com/topology-version"
+
+// swiftTopology is the JSON document written to swift-cluster-configmap and
+// consumed by swift-ring-master to build account.ring.gz, container.ring.gz
+// and object.ring.gz.
+type swiftTopology struct {
+	Nodes []swiftTopologyNode `json:"nodes"`
+}
+
+type swiftTopologyNode struct {
+	Name    string   `json:"name"`
+	IP      string   `json:"ip"`
+	Zone    string   `json:"zone,omitempty"`
+	Weight  float64  `json:"weight,omitempty"`
+	Devices []string `json:"devices"`
+}
+
+// withoutNode returns a copy of topo with the node named name removed, if
+// any. An empty name is a no-op, so plain rebalanceRings can share this
+// code path unconditionally.
+func (topo *swiftTopology) withoutNode(name string) *swiftTopology {
+	if name == "" {
+		return topo
+	}
+	filtered := &swiftTopology{Nodes: make([]swiftTopologyNode, 0, len(topo.Nodes))}
+	for _, n := range topo.Nodes {
+		if n.Name == name {
+			continue
+		}
+		filtered.Nodes = append(filtered.Nodes, n)
+	}
+	return filtered
+}
+
+// rebalanceRings recomputes the cluster topology from the current set of
+// StorageNodes in namespace, rewrites swift-cluster-configmap if the
+// topology changed, and signals swift-ring-master to rebuild and
+// redistribute the rings to every swift-ring-minion sidecar. It is safe to
+// call on every AddNode/UpdateNode/DeleteNode/UpdateCluster reconcile: if
+// the topology hasn't changed since the last call, it does nothing.
+func (st *SwiftStorage) rebalanceRings(namespace string) error {
+	return st.rebalanceRingsExcluding(namespace, "")
+}
+
+// rebalanceRingsExcluding is rebalanceRings with excludeName's devices left
+// out of the topology regardless of whether QM has removed its StorageNode
+// object yet. DeleteNode uses this instead of plain rebalanceRings because,
+// unlike the analogous DeleteClusterFunc ordering, nothing in this package
+// guarantees the StorageNode is gone from QM's store by the time DeleteNode
+// runs; excluding it explicitly keeps a deleted node's devices out of the
+// ring even if that assumption ever turns out to be wrong.
+func (st *SwiftStorage) rebalanceRingsExcluding(namespace, excludeName string) error {
+	topo, err := st.buildTopology(namespace)
+	if err != nil {
+		return logger.Err(err)
+	}
+	topo = topo.withoutNode(excludeName)
+
+	version, err := topologyHash(topo)
+	if err != nil {
+		return logger.Err(err)
+	}
+
+	changed, err := st.writeTopologyConfigMap(namespace, topo, version)
+	if err != nil {
+		return logger.Err(err)
+	}
+	if !changed {
+		logger.Debug("topology %v already applied, skipping rebalance", version)
+		return nil
+	}
+
+	if err := st.signalRingMaster(namespace); err != nil {
+		return logger.Err(err)
+	}
+
+	logger.Info("rebalanced swift rings in %v, topology version %v", namespace, version)
+	return nil
+}
+
+// buildTopology lists every StorageNode in namespace and turns it into the
+// topology document swift-ring-master understands.
+func (st *SwiftStorage) buildTopology(namespace string) (*swiftTopology, error) {
+	nodes, err := st.listStorageNodes(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := st.getClusterForNamespace(namespace)
+	if err != nil {
+		logger.Debug("no cluster found for %v yet, falling back to node IPs: %v", namespace, err)
+	}
+
+	topo := &swiftTopology{}
+	for _, n := range nodes {
+		host := ""
+		if cluster != nil && !useHostPath(cluster) {
+			// StatefulSet-backed node: use its stable DNS name so the
+			// ring survives a pod reschedule instead of chasing a
+			// ClusterIP.
+			host = storageNodeHostname(&n)
+		} else if len(n.Spec.StorageNetwork.IPs) > 0 {
+			host = n.Spec.StorageNetwork.IPs[0]
+		} else {
+			logger.Debug("node %v has no storage network IP, skipping from topology", n.GetName())
+			continue
+		}
+
+		topo.Nodes = append(topo.Nodes, swiftTopologyNode{
+			Name:    n.GetName(),
+			IP:      host,
+			Zone:    n.Spec.Zone,
+			Weight:  n.Spec.Weight,
+			Devices: n.Spec.Devices,
+		})
+	}
+	return topo, nil
+}
+
+// listStorageNodes returns every StorageNode QM knows about in namespace.
+// It's a thin wrapper around the listStorageNodesFn package variable so
+// tests can stub it out the same way they stub waitForDeploymentFn.
+func (st *SwiftStorage) listStorageNodes(namespace string) ([]spec.StorageNode, error) {
+	return listStorageNodesFn(st, namespace)
+}
+
+var listStorageNodesFn = func(st *SwiftStorage, namespace string) ([]spec.StorageNode, error) {
+	list := &spec.StorageNodeList{}
+	err := st.qm.Get().
+		Namespace(namespace).
+		Resource("storagenodes").
+		Do().
+		Into(list)
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// topologyHash is used as the topology-version annotation, so repeated
+// reconciles of an unchanged topology are cheap and retry-safe.
+func topologyHash(topo *swiftTopology) (string, error) {
+	data, err := json.Marshal(topo)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeTopologyConfigMap creates or updates swift-cluster-configmap with
+// topo, stamping it with version. It returns false when the configmap
+// already carries this exact version, so the caller can skip signalling
+// swift-ring-master for no reason.
+func (st *SwiftStorage) writeTopologyConfigMap(namespace string, topo *swiftTopology, version string) (bool, error) {
+	data, err := json.Marshal(topo)
+	if err != nil {
+		return false, err
+	}
+
+	configMaps := st.client.Core().ConfigMaps(namespace)
+	existing, err := configMaps.Get("swift-cluster-configmap", meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm := &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      "swift-cluster-configmap",
+				Namespace: namespace,
+				Labels: map[string]string{
+					"quartermaster": "swift",
+				},
+				Annotations: map[string]string{
+					topologyVersionAnnotation: version,
+				},
+				OwnerReferences: st.ownerReferencesForNamespace(namespace),
+			},
+			Data: map[string]string{
+				"cluster.json": string(data),
+			},
+		}
+		_, err = configMaps.Create(cm)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return false, err
+		}
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if existing.Annotations[topologyVersionAnnotation] == version {
+		return false, nil
+	}
+
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[topologyVersionAnnotation] = version
+	existing.Data["cluster.json"] = string(data)
+	_, err = configMaps.Update(existing)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// signalRingMaster forces swift-ring-master to reload the topology
+// configmap and rebuild the rings, by patching a restart annotation onto
+// its pod template. That triggers a rolling restart which every
+// swift-ring-minion sidecar picks up on its next sync.
+func (st *SwiftStorage) signalRingMaster(namespace string) error {
+	deployments := st.client.Extensions().Deployments(namespace)
+	patch := []byte(fmt.Sprintf(
+		`{"spec":{"template":{"metadata":{"annotations":{"swift.quartermaster.coreos.com/restartedAt":%q}}}}}`,
+		time.Now().UTC().Format(time.RFC3339)))
+
+	_, err := deployments.Patch("swift-ring-master-deploy", types.StrategicMergePatchType, patch)
+	if apierrors.IsNotFound(err) {
+		// Ring master isn't deployed yet, e.g. during the first AddCluster
+		// call before createRings has created it. Nothing to signal.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"fmt"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
+)
+
+// useHostPath reports whether c is pinned to the legacy single-replica,
+// HostPath-backed Deployment mode instead of the default PVC-backed
+// StatefulSet mode. Existing clusters can set this to keep their current
+// behavior across an upgrade.
+func useHostPath(c *spec.StorageCluster) bool {
+	return c.Spec.Swift.UseHostPath
+}
+
+// getClusterForNamespace returns the StorageCluster driving namespace.
+// Like the rest of this package, it assumes one Swift StorageCluster per
+// namespace. It's a thin wrapper around the getClusterForNamespaceFn
+// package variable so tests can stub it out the same way they stub
+// waitForDeploymentFn.
+func (st *SwiftStorage) getClusterForNamespace(namespace string) (*spec.StorageCluster, error) {
+	return getClusterForNamespaceFn(st, namespace)
+}
+
+var getClusterForNamespaceFn = func(st *SwiftStorage, namespace string) (*spec.StorageCluster, error) {
+	list := &spec.StorageClusterList{}
+	err := st.qm.Get().
+		Namespace(namespace).
+		Resource("storageclusters").
+		Do().
+		Into(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no StorageCluster found in namespace %v", namespace)
+	}
+	return &list.Items[0], nil
+}
+
+// ensureHeadlessService creates the headless Service a StorageNode's
+// StatefulSet needs so its pod gets the stable <node>-0.<svc> DNS name the
+// ring topology relies on instead of a ClusterIP.
+func (st *SwiftStorage) ensureHeadlessService(s *spec.StorageNode) error {
+	svc := &v1.Service{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            s.GetName() + "-svc",
+			Namespace:       s.Namespace,
+			OwnerReferences: []meta.OwnerReference{ownerReferenceForNode(s)},
+			Labels: map[string]string{
+				"swift":         "swift-storage",
+				"quartermaster": "swift",
+			},
+			Annotations: map[string]string{
+				"description": "Headless service giving swift storage node " + s.GetName() + " a stable network identity",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{
+				"swift_storage": s.GetName(),
+			},
+			ClusterIP: v1.ClusterIPNone,
+			Ports: []v1.ServicePort{
+				{Name: "account", Port: 6200},
+				{Name: "container", Port: 6201},
+				{Name: "object", Port: 6202},
+			},
+		},
+	}
+
+	services := st.client.Core().Services(s.Namespace)
+	_, err := services.Create(svc)
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// ensureStorageStatefulSet creates or updates the StatefulSet backing
+// StorageNode s, with one volumeClaimTemplates entry per device in
+// s.Spec.Devices so every device gets its own PVC instead of sharing a
+// single HostPath, using the StorageClass/size/access mode from the
+// cluster's Spec.StoragePolicy.
+func (st *SwiftStorage) ensureStorageStatefulSet(c *spec.StorageCluster, s *spec.StorageNode) error {
+	policy := c.Spec.Swift.StoragePolicy
+
+	devices := s.Spec.Devices
+	if len(devices) == 0 {
+		devices = []string{"d1"}
+	}
+
+	size, err := resource.ParseQuantity(policy.Size)
+	if err != nil {
+		return fmt.Errorf("invalid storage policy size %q: %v", policy.Size, err)
+	}
+
+	claims := make([]v1.PersistentVolumeClaim, 0, len(devices))
+	mounts := make([]v1.VolumeMount, 0, len(devices))
+	for _, device := range devices {
+		claims = append(claims, v1.PersistentVolumeClaim{
+			ObjectMeta: meta.ObjectMeta{
+				Name: device,
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &policy.StorageClassName,
+				AccessModes: []v1.PersistentVolumeAccessMode{
+					v1.PersistentVolumeAccessMode(policy.AccessMode),
+				},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: size,
+					},
+				},
+			},
+		})
+		mounts = append(mounts, v1.VolumeMount{
+			Name:      device,
+			MountPath: "/srv/node/" + device,
+		})
+	}
+
+	lmap := map[string]string{
+		"quartermaster": s.Name,
+		"swift_storage": s.GetName(),
+	}
+
+	replicas := int32(1)
+	sts := &appsv1beta1.StatefulSet{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            s.Name,
+			Namespace:       s.Namespace,
+			OwnerReferences: []meta.OwnerReference{ownerReferenceForNode(s)},
+			Annotations:     s.Annotations,
+			Labels:          lmap,
+		},
+		Spec: appsv1beta1.StatefulSetSpec{
+			ServiceName: s.GetName() + "-svc",
+			Replicas:    &replicas,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: meta.ObjectMeta{
+					Labels: lmap,
+				},
+				Spec: v1.PodSpec{
+					NodeName:     s.Spec.NodeName,
+					NodeSelector: s.Spec.NodeSelector,
+					Containers: []v1.Container{
+						{
+							Name:            s.Name,
+							Image:           s.Spec.Image,
+							ImagePullPolicy: v1.PullIfNotPresent,
+							VolumeMounts:    mounts,
+							Ports: []v1.ContainerPort{
+								{ContainerPort: 6200},
+								{ContainerPort: 6201},
+								{ContainerPort: 6202},
+							},
+						},
+						{
+							Name:            "swift-ring-minion",
+							Image:           "thiagodasilva/swift_ring_minion:dev-v5",
+							ImagePullPolicy: v1.PullIfNotPresent,
+							VolumeMounts:    mounts,
+						},
+					},
+				},
+			},
+			VolumeClaimTemplates: claims,
+		},
+	}
+
+	statefulSets := st.client.Apps().StatefulSets(s.Namespace)
+	_, err = statefulSets.Create(sts)
+	if apierrors.IsAlreadyExists(err) {
+		// VolumeClaimTemplates is immutable once the StatefulSet exists, and
+		// blindly Updating a freshly-built object would drop its
+		// ResourceVersion and race a concurrent writer. Fetch the live
+		// object and patch only the fields AddNode/UpdateNode are allowed to
+		// change.
+		existing, getErr := statefulSets.Get(s.Name, meta.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		existing.Spec.Replicas = sts.Spec.Replicas
+		existing.Spec.Template = sts.Spec.Template
+		existing.Labels = sts.Labels
+		existing.Annotations = sts.Annotations
+		_, err = statefulSets.Update(existing)
+	}
+	return err
+}
+
+func (st *SwiftStorage) deleteStorageStatefulSet(s *spec.StorageNode) error {
+	orphanDependents := false
+	err := st.client.Apps().StatefulSets(s.Namespace).Delete(s.Name,
+		&meta.DeleteOptions{OrphanDependents: &orphanDependents})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// storageNodeHostname is the ring device hostname for a StatefulSet-backed
+// StorageNode: the stable <node>-0.<svc> DNS name, which survives pod
+// rescheduling, rather than the pod's ClusterIP.
+func storageNodeHostname(s *spec.StorageNode) string {
+	svcName := s.GetName() + "-svc"
+	return fmt.Sprintf("%s-0.%s.%s.svc.cluster.local", s.GetName(), svcName, s.Namespace)
+}
@@ -0,0 +1,474 @@
+// Copyright 2017 Thiago da Silva
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swift
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/quartermaster/pkg/spec"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const testNamespace = "swift-ns"
+
+// newTestStorage builds a SwiftStorage backed by a fake clientset, and
+// stubs every package-level seam (waitForDeploymentFn, waitForGateFn,
+// listStorageNodesFn, getClusterForNamespaceFn, setClusterPhaseFn) so tests never block on a
+// real Kubernetes API server or QM apiserver.
+func newTestStorage(t *testing.T, cluster *spec.StorageCluster) (*SwiftStorage, kubernetes.Interface) {
+	t.Helper()
+
+	client := fake.NewSimpleClientset()
+	st := &SwiftStorage{client: client}
+
+	waitForDeploymentFn = func(kubernetes.Interface, string, string, int32) error { return nil }
+	waitForGateFn = func(func() error, time.Duration) error { return nil }
+	listStorageNodesFn = func(*SwiftStorage, string) ([]spec.StorageNode, error) { return nil, nil }
+	getClusterForNamespaceFn = func(*SwiftStorage, string) (*spec.StorageCluster, error) {
+		if cluster == nil {
+			return nil, fmt.Errorf("no cluster configured for this test")
+		}
+		return cluster, nil
+	}
+	setClusterPhaseFn = func(_ *SwiftStorage, c *spec.StorageCluster, phase string) error {
+		c.Status.Phase = phase
+		return nil
+	}
+
+	return st, client
+}
+
+func testCluster() *spec.StorageCluster {
+	c := &spec.StorageCluster{}
+	c.Name = "test-swift"
+	c.Namespace = testNamespace
+	c.Spec.Swift.UseHostPath = true // exercise the legacy, non-StatefulSet path
+	c.Spec.Swift.Auth.TempAuth = &spec.SwiftTempAuthSpec{
+		Users: map[string]string{
+			"admin": "testpass",
+		},
+	}
+	return c
+}
+
+func TestAddClusterCreatesExpectedObjects(t *testing.T) {
+	st, client := newTestStorage(t, testCluster())
+	c := testCluster()
+
+	if _, err := st.AddCluster(c); err != nil {
+		t.Fatalf("AddCluster() returned error: %v", err)
+	}
+
+	cm, err := client.Core().ConfigMaps(testNamespace).Get("swift-cluster-configmap", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-cluster-configmap to exist: %v", err)
+	}
+	if _, ok := cm.Data["cluster.json"]; !ok {
+		t.Errorf("expected swift-cluster-configmap to have a cluster.json key")
+	}
+
+	ringMaster, err := client.Extensions().Deployments(testNamespace).Get("swift-ring-master-deploy", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-ring-master-deploy to exist: %v", err)
+	}
+	if ringMaster.Labels["quartermaster"] != "swift" {
+		t.Errorf("expected swift-ring-master-deploy to carry the quartermaster=swift label, got %v", ringMaster.Labels)
+	}
+
+	proxy, err := client.Extensions().Deployments(testNamespace).Get("swift-proxy-deploy", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-proxy-deploy to exist: %v", err)
+	}
+	assertPorts(t, proxy, 8080)
+
+	if _, err := client.Core().Services(testNamespace).Get("swift-ring-master-svc", meta.GetOptions{}); err != nil {
+		t.Errorf("expected swift-ring-master-svc to exist: %v", err)
+	}
+	if _, err := client.Core().Services(testNamespace).Get("swiftservice", meta.GetOptions{}); err != nil {
+		t.Errorf("expected swiftservice to exist: %v", err)
+	}
+}
+
+func TestCreateRingsRecreatesServiceDeletedOutFromUnderDeployment(t *testing.T) {
+	st, client := newTestStorage(t, testCluster())
+	c := testCluster()
+
+	if _, err := st.AddCluster(c); err != nil {
+		t.Fatalf("AddCluster() returned error: %v", err)
+	}
+
+	if err := client.Core().Services(testNamespace).Delete("swift-ring-master-svc", nil); err != nil {
+		t.Fatalf("failed to delete swift-ring-master-svc to simulate drift: %v", err)
+	}
+
+	// createRings is what syncSwift calls on every drift resync; the
+	// ring-master Deployment already exists (Create hits AlreadyExists),
+	// but that must not skip recreating the Service.
+	if err := st.createRings(c); err != nil {
+		t.Fatalf("createRings() returned error: %v", err)
+	}
+
+	if _, err := client.Core().Services(testNamespace).Get("swift-ring-master-svc", meta.GetOptions{}); err != nil {
+		t.Errorf("expected swift-ring-master-svc to be recreated, got err=%v", err)
+	}
+}
+
+func TestDeleteClusterRemovesObjectsAndToleratesAlreadyGone(t *testing.T) {
+	st, client := newTestStorage(t, testCluster())
+	c := testCluster()
+
+	if _, err := st.AddCluster(c); err != nil {
+		t.Fatalf("AddCluster() returned error: %v", err)
+	}
+
+	if err := st.DeleteCluster(c); err != nil {
+		t.Fatalf("DeleteCluster() returned error: %v", err)
+	}
+
+	for _, name := range []string{"swift-proxy-deploy", "swift-ring-master-deploy"} {
+		if _, err := client.Extensions().Deployments(testNamespace).Get(name, meta.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected %v to be deleted, got err=%v", name, err)
+		}
+	}
+	for _, name := range []string{"swiftservice", "swift-ring-master-svc"} {
+		if _, err := client.Core().Services(testNamespace).Get(name, meta.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected %v to be deleted, got err=%v", name, err)
+		}
+	}
+	if _, err := client.Core().ConfigMaps(testNamespace).Get("swift-cluster-configmap", meta.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected swift-cluster-configmap to be deleted, got err=%v", err)
+	}
+
+	// Calling it again must tolerate every object already being gone.
+	if err := st.DeleteCluster(c); err != nil {
+		t.Fatalf("DeleteCluster() on an already-deleted cluster returned error: %v", err)
+	}
+}
+
+func TestMakeDeploymentPorts(t *testing.T) {
+	st, _ := newTestStorage(t, testCluster())
+
+	node := &spec.StorageNode{}
+	node.Name = "swift-node-1"
+	node.Namespace = testNamespace
+
+	deploy, err := st.MakeDeployment(node, nil)
+	if err != nil {
+		t.Fatalf("MakeDeployment() returned error: %v", err)
+	}
+	assertPorts(t, deploy, 6200, 6201, 6202)
+}
+
+func TestMakeDeploymentDefaultsImageOnlyWhenEmpty(t *testing.T) {
+	st, _ := newTestStorage(t, testCluster())
+
+	node := &spec.StorageNode{}
+	node.Name = "swift-node-1"
+	node.Namespace = testNamespace
+
+	deploy, err := st.MakeDeployment(node, nil)
+	if err != nil {
+		t.Fatalf("MakeDeployment() returned error: %v", err)
+	}
+	if got := deploy.Spec.Template.Spec.Containers[0].Image; got != "thiagodasilva/swift-storage:dev-v1" {
+		t.Errorf("expected default image, got %v", got)
+	}
+
+	node2 := &spec.StorageNode{}
+	node2.Name = "swift-node-2"
+	node2.Namespace = testNamespace
+	node2.Spec.Image = "example.com/custom-swift-storage:v9"
+
+	deploy2, err := st.MakeDeployment(node2, nil)
+	if err != nil {
+		t.Fatalf("MakeDeployment() returned error: %v", err)
+	}
+	if got := deploy2.Spec.Template.Spec.Containers[0].Image; got != "example.com/custom-swift-storage:v9" {
+		t.Errorf("expected custom image to be preserved, got %v", got)
+	}
+}
+
+func TestAddNodeCreatesServiceFromStorageNetwork(t *testing.T) {
+	// testCluster() is pinned to UseHostPath, so AddNode takes the legacy,
+	// ClusterIP-based Service path.
+	st, client := newTestStorage(t, testCluster())
+
+	node := &spec.StorageNode{}
+	node.Name = "swift-node-1"
+	node.Namespace = testNamespace
+	node.Spec.StorageNetwork.IPs = []string{"10.1.2.3"}
+
+	if _, err := st.AddNode(node); err != nil {
+		t.Fatalf("AddNode() returned error: %v", err)
+	}
+
+	svc, err := client.Core().Services(testNamespace).Get("swift-node-1-svc", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-node-1-svc to exist: %v", err)
+	}
+	if svc.Spec.ClusterIP != "10.1.2.3" {
+		t.Errorf("expected ClusterIP %v, got %v", "10.1.2.3", svc.Spec.ClusterIP)
+	}
+}
+
+func TestAddNodeToleratesAlreadyExists(t *testing.T) {
+	st, client := newTestStorage(t, testCluster())
+
+	node := &spec.StorageNode{}
+	node.Name = "swift-node-1"
+	node.Namespace = testNamespace
+	node.Spec.StorageNetwork.IPs = []string{"10.1.2.3"}
+
+	if _, err := st.AddNode(node); err != nil {
+		t.Fatalf("first AddNode() returned error: %v", err)
+	}
+
+	if err := client.Core().ConfigMaps(testNamespace).Delete("swift-cluster-configmap", nil); err != nil {
+		t.Fatalf("failed to delete swift-cluster-configmap to detect a skipped rebalance: %v", err)
+	}
+
+	result, err := st.AddNode(node)
+	if err != nil {
+		t.Fatalf("AddNode() on an already-existing node returned error: %v", err)
+	}
+	if result != nil {
+		t.Errorf("expected AddNode() to return a nil node on AlreadyExists, got %v", result)
+	}
+
+	// A retried AddNode must still rebalance even though the Service
+	// AlreadyExists, instead of returning before reaching rebalanceRings.
+	if _, err := client.Core().ConfigMaps(testNamespace).Get("swift-cluster-configmap", meta.GetOptions{}); err != nil {
+		t.Errorf("expected AddNode() to rebalance rings on retry, swift-cluster-configmap missing: %v", err)
+	}
+}
+
+func TestRebalanceRingsIdempotent(t *testing.T) {
+	st, client := newTestStorage(t, testCluster())
+
+	origListStorageNodesFn := listStorageNodesFn
+	defer func() { listStorageNodesFn = origListStorageNodesFn }()
+	listStorageNodesFn = func(*SwiftStorage, string) ([]spec.StorageNode, error) {
+		node := spec.StorageNode{}
+		node.Name = "swift-node-1"
+		node.Spec.StorageNetwork.IPs = []string{"10.1.2.3"}
+		node.Spec.Devices = []string{"d1"}
+		return []spec.StorageNode{node}, nil
+	}
+
+	if err := st.rebalanceRings(testNamespace); err != nil {
+		t.Fatalf("first rebalanceRings() returned error: %v", err)
+	}
+
+	cm, err := client.Core().ConfigMaps(testNamespace).Get("swift-cluster-configmap", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-cluster-configmap to exist: %v", err)
+	}
+	firstVersion := cm.ResourceVersion
+
+	if err := st.rebalanceRings(testNamespace); err != nil {
+		t.Fatalf("second rebalanceRings() returned error: %v", err)
+	}
+
+	cm, err = client.Core().ConfigMaps(testNamespace).Get("swift-cluster-configmap", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected swift-cluster-configmap to still exist: %v", err)
+	}
+	if cm.ResourceVersion != firstVersion {
+		t.Errorf("expected rebalanceRings() to be a no-op on an unchanged topology, but ResourceVersion changed %v -> %v", firstVersion, cm.ResourceVersion)
+	}
+}
+
+func TestRunInstallPhasesRollsBackFailedPhaseAndItsPredecessors(t *testing.T) {
+	st, _ := newTestStorage(t, testCluster())
+	c := testCluster()
+
+	var firstRolledBack, secondRolledBack bool
+
+	phases := []installPhase{
+		{
+			name:  "first",
+			phase: ClusterPhaseRingMaster,
+			create: func() error { return nil },
+			gate:   func() error { return nil },
+			rollback: func() error {
+				firstRolledBack = true
+				return nil
+			},
+		},
+		{
+			name:  "second",
+			phase: ClusterPhaseProxy,
+			create: func() error {
+				// Simulates create() having already made some API calls
+				// (e.g. a Deployment) before failing on a later one.
+				return fmt.Errorf("second phase create failed partway through")
+			},
+			gate: func() error { return nil },
+			rollback: func() error {
+				secondRolledBack = true
+				return nil
+			},
+		},
+	}
+
+	if err := st.runInstallPhases(c, phases); err == nil {
+		t.Fatalf("expected runInstallPhases() to return an error")
+	}
+
+	if !firstRolledBack {
+		t.Errorf("expected the first, fully-completed phase to be rolled back")
+	}
+	if !secondRolledBack {
+		t.Errorf("expected the second phase, which failed partway through its own create(), to be rolled back too")
+	}
+}
+
+func TestRenderProxyServerConfTempAuth(t *testing.T) {
+	st, _ := newTestStorage(t, nil)
+	c := testCluster()
+
+	rendered, version, err := st.renderProxyServerConf(c)
+	if err != nil {
+		t.Fatalf("renderProxyServerConf() returned error: %v", err)
+	}
+
+	if !strings.Contains(rendered, "pipeline = catch_errors gatekeeper healthcheck proxy-logging cache tempauth proxy-logging proxy-server") {
+		t.Errorf("expected pipeline to include tempauth, got:\n%v", rendered)
+	}
+	if !strings.Contains(rendered, "user_admin = testpass") {
+		t.Errorf("expected rendered config to include the TempAuth user line, got:\n%v", rendered)
+	}
+	if strings.Contains(rendered, "keystoneauth") {
+		t.Errorf("expected no keystoneauth filter when only TempAuth is configured, got:\n%v", rendered)
+	}
+	if version == "" {
+		t.Errorf("expected a non-empty config version hash")
+	}
+}
+
+func TestRenderProxyServerConfKeystone(t *testing.T) {
+	st, client := newTestStorage(t, nil)
+	c := testCluster()
+	c.Spec.Swift.Auth.TempAuth = nil
+	c.Spec.Swift.Auth.Keystone = &spec.SwiftKeystoneSpec{
+		SecretName:  "swift-keystone-admin",
+		AuthURL:     "http://keystone.example.com:5000/v2.0",
+		AdminUser:   "admin",
+		AdminTenant: "service",
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "swift-keystone-admin",
+			Namespace: testNamespace,
+		},
+		Data: map[string][]byte{
+			"admin-password": []byte("s3cr3t"),
+		},
+	}
+	if _, err := client.Core().Secrets(testNamespace).Create(secret); err != nil {
+		t.Fatalf("failed to create keystone admin secret: %v", err)
+	}
+
+	rendered, _, err := st.renderProxyServerConf(c)
+	if err != nil {
+		t.Fatalf("renderProxyServerConf() returned error: %v", err)
+	}
+
+	if !strings.Contains(rendered, "pipeline = catch_errors gatekeeper healthcheck proxy-logging cache authtoken keystoneauth proxy-logging proxy-server") {
+		t.Errorf("expected pipeline to include authtoken keystoneauth, got:\n%v", rendered)
+	}
+	if !strings.Contains(rendered, "auth_url = http://keystone.example.com:5000/v2.0") {
+		t.Errorf("expected rendered config to include the Keystone auth_url, got:\n%v", rendered)
+	}
+	if !strings.Contains(rendered, "admin_password = s3cr3t") {
+		t.Errorf("expected rendered config to include the password pulled from the Secret, got:\n%v", rendered)
+	}
+	if strings.Contains(rendered, "tempauth") {
+		t.Errorf("expected no tempauth filter when only Keystone is configured, got:\n%v", rendered)
+	}
+}
+
+func TestEnqueueOwnerMatchesAndIgnoresOwnerReferences(t *testing.T) {
+	c := &swiftController{
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "swift-test"),
+	}
+
+	owned := &v1.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "swift-cluster-configmap",
+			Namespace: testNamespace,
+			OwnerReferences: []meta.OwnerReference{
+				{Kind: "StorageCluster", Name: "test-swift"},
+			},
+		},
+	}
+	c.enqueueOwner(owned)
+	if got := c.queue.Len(); got != 1 {
+		t.Fatalf("expected enqueueOwner() to queue an object owned by a StorageCluster, queue length %v", got)
+	}
+	key, _ := c.queue.Get()
+	if key.(string) != testNamespace+"/test-swift" {
+		t.Errorf("expected queued key %v/test-swift, got %v", testNamespace, key)
+	}
+
+	unowned := &v1.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "unrelated-configmap",
+			Namespace: testNamespace,
+			OwnerReferences: []meta.OwnerReference{
+				{Kind: "SomeOtherKind", Name: "not-a-storage-cluster"},
+			},
+		},
+	}
+	c.enqueueOwner(unowned)
+	if got := c.queue.Len(); got != 0 {
+		t.Errorf("expected enqueueOwner() to ignore an object with no StorageCluster owner reference, queue length %v", got)
+	}
+}
+
+func assertPorts(t *testing.T, deploy *v1beta1.Deployment, want ...int32) {
+	t.Helper()
+
+	var got []int32
+	for _, container := range deploy.Spec.Template.Spec.Containers {
+		for _, p := range container.Ports {
+			got = append(got, p.ContainerPort)
+		}
+	}
+
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected port %v among container ports, got %v", w, got)
+		}
+	}
+}